@@ -0,0 +1,240 @@
+// Copyright 2023 Harshavardhana
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package batch implements size/duration/memory-bounded batching of
+// minio.ObjectInfo entries, shared by both ziptransfer mains so neither has
+// to hardcode a fixed-count flush threshold.
+package batch
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"runtime"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/minio/minio-go/v7"
+)
+
+// FlushReason identifies which threshold forced a Batcher to flush.
+type FlushReason string
+
+const (
+	// FlushMaxObjects means the batch reached BatcherConfig.MaxObjects.
+	FlushMaxObjects FlushReason = "max_objects"
+	// FlushMaxBytes means the batch reached BatcherConfig.MaxBytes.
+	FlushMaxBytes FlushReason = "max_bytes"
+	// FlushMaxDuration means the batch has been open longer than
+	// BatcherConfig.MaxDuration.
+	FlushMaxDuration FlushReason = "max_duration"
+	// FlushMemoryPressure means process heap usage crossed
+	// BatcherConfig.MemoryHighWaterMark.
+	FlushMemoryPressure FlushReason = "memory_pressure"
+	// FlushFinal is used for the trailing, partial batch flushed once
+	// listing finishes.
+	FlushFinal FlushReason = "final"
+)
+
+// BatcherConfig bounds how large, and how long-lived, a batch of entries
+// may grow before Batcher forces a flush. A zero value for any field
+// disables that particular threshold.
+type BatcherConfig struct {
+	MaxBytes   int64
+	MaxObjects int
+	// MaxDuration caps how long a batch may stay open once it has its
+	// first entry.
+	MaxDuration time.Duration
+	// MemoryHighWaterMark, checked against runtime.MemStats.HeapInuse,
+	// forces a flush before the process's working set grows further --
+	// most useful together with the InMemory snowball mode.
+	MemoryHighWaterMark uint64
+}
+
+// BatcherConfigFromEnv reads BATCH_MAX_BYTES, BATCH_MAX_OBJECTS,
+// BATCH_MAX_DURATION and BATCH_MEM_HIGH_WATERMARK. BATCH_MAX_OBJECTS
+// defaults to 100, matching the tool's original fixed-count flush.
+func BatcherConfigFromEnv() BatcherConfig {
+	cfg := BatcherConfig{MaxObjects: 100}
+
+	if v, err := strconv.ParseInt(os.Getenv("BATCH_MAX_BYTES"), 10, 64); err == nil && v > 0 {
+		cfg.MaxBytes = v
+	}
+	if v, err := strconv.Atoi(os.Getenv("BATCH_MAX_OBJECTS")); err == nil && v > 0 {
+		cfg.MaxObjects = v
+	}
+	if v, err := time.ParseDuration(os.Getenv("BATCH_MAX_DURATION")); err == nil && v > 0 {
+		cfg.MaxDuration = v
+	}
+	if v, err := strconv.ParseUint(os.Getenv("BATCH_MEM_HIGH_WATERMARK"), 10, 64); err == nil && v > 0 {
+		cfg.MemoryHighWaterMark = v
+	}
+
+	return cfg
+}
+
+// Batcher accumulates minio.ObjectInfo entries and decides, on each Add,
+// whether the pending batch must be flushed before the new entry can join
+// it -- whichever of MaxBytes, MaxObjects, MaxDuration or
+// MemoryHighWaterMark is hit first.
+type Batcher struct {
+	cfg     BatcherConfig
+	metrics *BatchMetrics
+
+	mu      sync.Mutex
+	entries []minio.ObjectInfo
+	bytes   int64
+	opened  time.Time
+}
+
+// NewBatcher creates a Batcher bounded by cfg. metrics may be nil to skip
+// instrumentation.
+func NewBatcher(cfg BatcherConfig, metrics *BatchMetrics) *Batcher {
+	return &Batcher{cfg: cfg, metrics: metrics}
+}
+
+// Add appends entry to the batch. If admitting it would cross a configured
+// threshold, the pending batch (without entry) is flushed first and entry
+// starts the next one; the flushed entries are returned, or nil if nothing
+// needed flushing yet.
+func (b *Batcher) Add(entry minio.ObjectInfo) []minio.ObjectInfo {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	var reason FlushReason
+	switch {
+	case len(b.entries) == 0:
+		// Nothing to flush yet.
+	case b.cfg.MaxObjects > 0 && len(b.entries)+1 > b.cfg.MaxObjects:
+		reason = FlushMaxObjects
+	case b.cfg.MaxBytes > 0 && b.bytes+entry.Size > b.cfg.MaxBytes:
+		reason = FlushMaxBytes
+	case b.cfg.MaxDuration > 0 && time.Since(b.opened) > b.cfg.MaxDuration:
+		reason = FlushMaxDuration
+	case b.cfg.MemoryHighWaterMark > 0 && heapInUse() > b.cfg.MemoryHighWaterMark:
+		reason = FlushMemoryPressure
+	}
+
+	var flushed []minio.ObjectInfo
+	if reason != "" {
+		flushed = b.entries
+		if b.metrics != nil {
+			b.metrics.observe(reason, len(flushed), b.bytes)
+		}
+		b.entries = nil
+		b.bytes = 0
+	}
+
+	if len(b.entries) == 0 {
+		b.opened = time.Now()
+	}
+	b.entries = append(b.entries, entry)
+	b.bytes += entry.Size
+
+	return flushed
+}
+
+// Flush unconditionally drains and returns the pending batch, e.g. once a
+// bucket listing is exhausted.
+func (b *Batcher) Flush() []minio.ObjectInfo {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	entries := b.entries
+	if len(entries) > 0 && b.metrics != nil {
+		b.metrics.observe(FlushFinal, len(entries), b.bytes)
+	}
+	b.entries = nil
+	b.bytes = 0
+	return entries
+}
+
+func heapInUse() uint64 {
+	var stats runtime.MemStats
+	runtime.ReadMemStats(&stats)
+	return stats.HeapInuse
+}
+
+// BatchMetrics counts Batcher flushes, broken down by FlushReason, and the
+// running totals needed to report average batch size. It is safe for
+// concurrent use.
+type BatchMetrics struct {
+	mu              sync.Mutex
+	flushesByReason map[FlushReason]uint64
+	objectsTotal    uint64
+	bytesTotal      uint64
+}
+
+// NewBatchMetrics returns an empty BatchMetrics.
+func NewBatchMetrics() *BatchMetrics {
+	return &BatchMetrics{flushesByReason: make(map[FlushReason]uint64)}
+}
+
+func (m *BatchMetrics) observe(reason FlushReason, objects int, bytes int64) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.flushesByReason[reason]++
+	m.objectsTotal += uint64(objects)
+	m.bytesTotal += uint64(bytes)
+}
+
+// ServeHTTP renders the counters in Prometheus text exposition format.
+func (m *BatchMetrics) ServeHTTP(w http.ResponseWriter, _ *http.Request) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var flushesTotal uint64
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+
+	fmt.Fprintln(w, "# HELP ziptransfer_batches_flushed_total Number of batches flushed, by reason.")
+	fmt.Fprintln(w, "# TYPE ziptransfer_batches_flushed_total counter")
+	for reason, count := range m.flushesByReason {
+		fmt.Fprintf(w, "ziptransfer_batches_flushed_total{reason=%q} %d\n", reason, count)
+		flushesTotal += count
+	}
+
+	fmt.Fprintln(w, "# HELP ziptransfer_batch_objects_avg Average number of objects per flushed batch.")
+	fmt.Fprintln(w, "# TYPE ziptransfer_batch_objects_avg gauge")
+	fmt.Fprintf(w, "ziptransfer_batch_objects_avg %f\n", safeAvg(m.objectsTotal, flushesTotal))
+
+	fmt.Fprintln(w, "# HELP ziptransfer_batch_bytes_avg Average bytes per flushed batch.")
+	fmt.Fprintln(w, "# TYPE ziptransfer_batch_bytes_avg gauge")
+	fmt.Fprintf(w, "ziptransfer_batch_bytes_avg %f\n", safeAvg(m.bytesTotal, flushesTotal))
+}
+
+func safeAvg(total, count uint64) float64 {
+	if count == 0 {
+		return 0
+	}
+	return float64(total) / float64(count)
+}
+
+// ServeMetrics starts an HTTP server exposing metrics at /metrics on addr,
+// if addr is non-empty. It runs for the lifetime of the process; a
+// listener error is logged but does not abort the transfer.
+func ServeMetrics(addr string, metrics *BatchMetrics) {
+	if addr == "" {
+		return
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", metrics)
+	go func() {
+		if err := http.ListenAndServe(addr, mux); err != nil {
+			fmt.Println("ERROR: metrics server: ", err)
+		}
+	}()
+}
@@ -0,0 +1,58 @@
+// Copyright 2023 Harshavardhana
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package batch
+
+import (
+	"testing"
+
+	"github.com/minio/minio-go/v7"
+)
+
+func TestBatcherMaxObjects(t *testing.T) {
+	b := NewBatcher(BatcherConfig{MaxObjects: 2}, nil)
+
+	if flushed := b.Add(minio.ObjectInfo{Key: "a", Size: 1}); flushed != nil {
+		t.Fatalf("first Add flushed, want nil: %v", flushed)
+	}
+	if flushed := b.Add(minio.ObjectInfo{Key: "b", Size: 1}); flushed != nil {
+		t.Fatalf("second Add flushed, want nil: %v", flushed)
+	}
+	flushed := b.Add(minio.ObjectInfo{Key: "c", Size: 1})
+	if len(flushed) != 2 || flushed[0].Key != "a" || flushed[1].Key != "b" {
+		t.Fatalf("third Add flushed = %v, want [a b]", flushed)
+	}
+
+	remaining := b.Flush()
+	if len(remaining) != 1 || remaining[0].Key != "c" {
+		t.Fatalf("Flush = %v, want [c]", remaining)
+	}
+}
+
+func TestBatcherMaxBytes(t *testing.T) {
+	b := NewBatcher(BatcherConfig{MaxBytes: 100}, nil)
+
+	b.Add(minio.ObjectInfo{Key: "a", Size: 60})
+	flushed := b.Add(minio.ObjectInfo{Key: "b", Size: 60})
+	if len(flushed) != 1 || flushed[0].Key != "a" {
+		t.Fatalf("Add crossing MaxBytes flushed = %v, want [a]", flushed)
+	}
+}
+
+func TestBatcherFlushEmpty(t *testing.T) {
+	b := NewBatcher(BatcherConfig{MaxObjects: 10}, nil)
+	if flushed := b.Flush(); flushed != nil {
+		t.Fatalf("Flush on empty batcher = %v, want nil", flushed)
+	}
+}
@@ -2,7 +2,9 @@ package main
 
 import (
 	"context"
+	"crypto/sha256"
 	"crypto/tls"
+	"encoding/hex"
 	"fmt"
 	"log"
 	"net"
@@ -10,6 +12,7 @@ import (
 	"os"
 	"path/filepath"
 	"runtime"
+	"sort"
 	"strings"
 	"time"
 
@@ -18,6 +21,9 @@ import (
 	"github.com/minio/minio-go/v7"
 	"github.com/minio/minio-go/v7/pkg/credentials"
 	"github.com/schollz/progressbar/v3"
+
+	"github.com/harshavardhana/ziptransfer/batch"
+	"github.com/harshavardhana/ziptransfer/encryption"
 )
 
 // GOOS specific ignore list.
@@ -110,6 +116,11 @@ func main() {
 		log.Fatalln(err)
 	}
 
+	sse, err := encryption.FromEnv("")
+	if err != nil {
+		log.Fatalln(err)
+	}
+
 	input := make(chan minio.SnowballObject)
 	opts := minio.SnowballOptions{
 		Opts: minio.PutObjectOptions{
@@ -187,33 +198,41 @@ func main() {
 	)
 	pb.Reset()
 
+	batcher := batch.NewBatcher(batch.BatcherConfigFromEnv(), nil)
+
 	doneCh := make(chan struct{})
 	go func() {
 		defer close(doneCh)
 
 		var totalObjs int
 		var totalSize int64
-		var entries []minio.SnowballObject
+		// pending mirrors batcher's own entries 1:1 (appended in the same
+		// order, flushed in the same order), since Batcher is built around
+		// minio.ObjectInfo and can't carry the open os.File handle a
+		// SnowballObject needs.
+		var pending []minio.SnowballObject
 		for {
 			select {
 			case sobj, ok := <-input:
 				if !ok {
-					if err := writeAsZip(minioClient, YOURBUCKET, opts, entries); err != nil {
-						pb.Describe(fmt.Sprintf("uploading failed at the end: %v", err))
-					} else {
-						pb.Describe(fmt.Sprintf("finished uploading %d number of objects, total size of %s", totalObjs, humanize.IBytes(uint64(totalSize))))
+					if flushed := batcher.Flush(); len(flushed) > 0 {
+						if err := writeAsZip(minioClient, YOURBUCKET, opts, sse, pending); err != nil {
+							pb.Describe(fmt.Sprintf("uploading failed at the end: %v", err))
+							return
+						}
 					}
+					pb.Describe(fmt.Sprintf("finished uploading %d number of objects, total size of %s", totalObjs, humanize.IBytes(uint64(totalSize))))
 					return
 				}
 
-				entries = append(entries, sobj)
-				if len(entries) == 100 {
-					if err := writeAsZip(minioClient, YOURBUCKET, opts, entries); err != nil {
+				if flushed := batcher.Add(minio.ObjectInfo{Key: sobj.Key, Size: sobj.Size, LastModified: sobj.ModTime}); flushed != nil {
+					if err := writeAsZip(minioClient, YOURBUCKET, opts, sse, pending); err != nil {
 						pb.Describe(fmt.Sprintf("uploading failed: %v", err))
 						return
 					}
-					entries = []minio.SnowballObject{}
+					pending = nil
 				}
+				pending = append(pending, sobj)
 				totalObjs++
 				totalSize += sobj.Size
 				pb.Set64(totalSize)
@@ -228,7 +247,26 @@ func main() {
 	// Objects successfully uploaded.
 }
 
-func writeAsZip(clnt *minio.Client, bucket string, opts minio.SnowballOptions, entries []minio.SnowballObject) error {
+// writeAsZip uploads entries as a single snowball tarball. sse, if
+// configured, is applied to the whole call via a per-call derived key:
+// PutObjectsSnowball accepts only one PutObjectOptions for every object it
+// packs, so (as with the main transfer tool) objects within one call share
+// a single SSE-C data key rather than each getting its own. Unlike the main
+// tool, this uploader keeps no manifest to persist the derivation salt in,
+// so the salt is derived from the batch's own file paths (reproducible as
+// long as the same root is walked again) and logged, rather than a random
+// value that would make the batch permanently undecryptable once this
+// function returns.
+func writeAsZip(clnt *minio.Client, bucket string, opts minio.SnowballOptions, sse encryption.Config, entries []minio.SnowballObject) error {
+	salt := snowballSalt(entries)
+	log.Printf("snowball batch of %d objects, SSE-C derivation salt: %s", len(entries), salt)
+
+	destSide, err := sse.ServerSide(salt)
+	if err != nil {
+		return err
+	}
+	opts.Opts.ServerSideEncryption = destSide
+
 	input := make(chan minio.SnowballObject, 1)
 
 	go func() {
@@ -248,3 +286,16 @@ func writeAsZip(clnt *minio.Client, bucket string, opts minio.SnowballOptions, e
 	// Collect and upload all entries.
 	return clnt.PutObjectsSnowball(context.Background(), bucket, opts, input)
 }
+
+// snowballSalt derives a deterministic SSE-C derivation salt from a batch's
+// object keys, sorted so batching order doesn't affect it.
+func snowballSalt(entries []minio.SnowballObject) string {
+	keys := make([]string, len(entries))
+	for i, entry := range entries {
+		keys[i] = entry.Key
+	}
+	sort.Strings(keys)
+
+	sum := sha256.Sum256([]byte(strings.Join(keys, "\x00")))
+	return hex.EncodeToString(sum[:])
+}
@@ -0,0 +1,151 @@
+// Copyright 2023 Harshavardhana
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package encryption builds minio-go server-side-encryption values from
+// environment configuration, so that both ziptransfer mains can read and
+// write SSE-C, SSE-KMS and SSE-S3 protected objects without duplicating
+// the env-parsing and key-derivation logic.
+package encryption
+
+import (
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/minio/minio-go/v7/pkg/encrypt"
+	"golang.org/x/crypto/hkdf"
+)
+
+// Mode identifies which flavor of server-side-encryption a Config builds.
+type Mode string
+
+const (
+	// ModeNone disables server-side-encryption entirely.
+	ModeNone Mode = ""
+	// ModeSSEC is server-side-encryption with a customer-provided key.
+	ModeSSEC Mode = "c"
+	// ModeSSEKMS is server-side-encryption with a KMS-managed key.
+	ModeSSEKMS Mode = "kms"
+	// ModeSSES3 is server-side-encryption with an S3-managed key.
+	ModeSSES3 Mode = "s3"
+)
+
+// Config describes how to build a server-side-encryption value for the
+// source or destination side of a transfer.
+type Config struct {
+	Mode Mode
+
+	// CKey is the SSE-C master key, as configured. It must be exactly 32
+	// bytes once decoded; see decodeCKey.
+	CKey []byte
+
+	// KMSKeyID and Context configure SSE-KMS.
+	KMSKeyID string
+	Context  map[string]string
+
+	// DeriveKeys, when true and Mode is ModeSSEC, makes ServerSide derive
+	// a distinct per-object data key from CKey via HKDF instead of
+	// reusing CKey directly for every object.
+	DeriveKeys bool
+}
+
+// FromEnv builds a Config from the SSE_MODE, SSE_C_KEY, SSE_KMS_KEY_ID and
+// SSE_CONTEXT environment variables. SSE_MODE selects the scheme ("c",
+// "kms" or "s3"); an empty or unset SSE_MODE disables encryption and
+// FromEnv returns a Config with Mode set to ModeNone.
+func FromEnv(prefix string) (Config, error) {
+	mode := Mode(os.Getenv(prefix + "SSE_MODE"))
+
+	cfg := Config{
+		Mode:       mode,
+		KMSKeyID:   os.Getenv(prefix + "SSE_KMS_KEY_ID"),
+		DeriveKeys: os.Getenv(prefix+"SSE_C_DERIVE") == "true",
+	}
+
+	if mode == ModeSSEC {
+		key, err := decodeCKey(os.Getenv(prefix + "SSE_C_KEY"))
+		if err != nil {
+			return Config{}, fmt.Errorf("encryption: %s: %w", prefix+"SSE_C_KEY", err)
+		}
+		cfg.CKey = key
+	}
+
+	if mode == ModeSSEKMS {
+		if ctx := os.Getenv(prefix + "SSE_CONTEXT"); ctx != "" {
+			cfg.Context = map[string]string{"key": ctx}
+		}
+	}
+
+	return cfg, nil
+}
+
+// decodeCKey accepts a raw 32 byte passphrase. Shorter or longer values
+// are expanded/condensed into a 256 bit key with SHA-256, matching the
+// common convention of passing an arbitrary-length passphrase on the
+// command line.
+func decodeCKey(s string) ([]byte, error) {
+	if s == "" {
+		return nil, errors.New("no SSE-C key configured")
+	}
+	if len(s) == 32 {
+		return []byte(s), nil
+	}
+	sum := sha256.Sum256([]byte(s))
+	return sum[:], nil
+}
+
+// ServerSide returns the encrypt.ServerSide value to use for objectKey, or
+// nil if Mode is ModeNone. For ModeSSEC with DeriveKeys set, a distinct
+// 256 bit data key is derived from CKey for each objectKey using HKDF, so
+// that compromising one object's key does not expose the others.
+func (c Config) ServerSide(objectKey string) (encrypt.ServerSide, error) {
+	switch c.Mode {
+	case ModeNone:
+		return nil, nil
+	case ModeSSES3:
+		return encrypt.NewSSE(), nil
+	case ModeSSEKMS:
+		var context interface{}
+		if len(c.Context) > 0 {
+			context = c.Context
+		}
+		return encrypt.NewSSEKMS(c.KMSKeyID, context)
+	case ModeSSEC:
+		key := c.CKey
+		if c.DeriveKeys {
+			derived, err := deriveObjectKey(c.CKey, objectKey)
+			if err != nil {
+				return nil, err
+			}
+			key = derived
+		}
+		return encrypt.NewSSEC(key)
+	default:
+		return nil, fmt.Errorf("encryption: unknown SSE mode %q", c.Mode)
+	}
+}
+
+// deriveObjectKey derives a 256 bit SSE-C key for objectKey from master
+// using HKDF-SHA256, so that every object is encrypted with its own data
+// key even though operators only configure a single master key.
+func deriveObjectKey(master []byte, objectKey string) ([]byte, error) {
+	h := hkdf.New(sha256.New, master, nil, []byte(objectKey))
+	key := make([]byte, 32)
+	if _, err := io.ReadFull(h, key); err != nil {
+		return nil, err
+	}
+	return key, nil
+}
@@ -0,0 +1,178 @@
+// Copyright 2023 Harshavardhana
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"math/rand"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/minio/minio-go/v7"
+)
+
+// Result is the outcome of packing a single object into the destination
+// bucket, yielded on writeAsZip's results channel.
+type Result struct {
+	Key string
+	Err error // nil on success
+}
+
+// ObjectError wraps a failure to copy a single object, recording whether
+// retrying the same operation could plausibly succeed.
+type ObjectError struct {
+	Key       string
+	Retryable bool
+	Err       error
+}
+
+func (e *ObjectError) Error() string { return fmt.Sprintf("%s: %v", e.Key, e.Err) }
+
+func (e *ObjectError) Unwrap() error { return e.Err }
+
+// classifyErr decides whether err, encountered while copying key, is worth
+// retrying. Access and existence errors (403, 404) and checksum mismatches
+// are terminal; everything else -- 5xx responses, throttling, and
+// network-level failures that never reach the S3 API -- is retryable.
+func classifyErr(key string, err error) *ObjectError {
+	if err == nil {
+		return nil
+	}
+
+	resp := minio.ToErrorResponse(err)
+	switch resp.StatusCode {
+	case http.StatusForbidden, http.StatusUnauthorized, http.StatusNotFound:
+		return &ObjectError{Key: key, Retryable: false, Err: err}
+	}
+	switch resp.Code {
+	case "BadDigest", "InvalidDigest":
+		return &ObjectError{Key: key, Retryable: false, Err: err}
+	}
+
+	return &ObjectError{Key: key, Retryable: true, Err: err}
+}
+
+// RetryConfig parameterizes withRetry's exponential backoff with full
+// jitter.
+type RetryConfig struct {
+	Base        time.Duration
+	Cap         time.Duration
+	MaxAttempts int
+}
+
+// DefaultRetry matches what operators expect from a long-running bulk
+// migration: quick recovery from transient blips, a bounded total wait
+// before an object is given up on.
+var DefaultRetry = RetryConfig{Base: 200 * time.Millisecond, Cap: 30 * time.Second, MaxAttempts: 5}
+
+// withRetry calls fn until it succeeds, returns a terminal *ObjectError, or
+// exhausts cfg.MaxAttempts, sleeping with exponential backoff and full
+// jitter between attempts.
+func withRetry(ctx context.Context, cfg RetryConfig, key string, fn func() error) error {
+	var lastErr error
+
+	for attempt := 0; attempt < cfg.MaxAttempts; attempt++ {
+		err := fn()
+		if err == nil {
+			return nil
+		}
+
+		objErr := classifyErr(key, err)
+		if !objErr.Retryable || attempt == cfg.MaxAttempts-1 {
+			return objErr
+		}
+		lastErr = objErr
+
+		backoff := cfg.Base << attempt
+		if backoff <= 0 || backoff > cfg.Cap {
+			backoff = cfg.Cap
+		}
+		sleep := time.Duration(rand.Int63n(int64(backoff)))
+
+		select {
+		case <-time.After(sleep):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+
+	return lastErr
+}
+
+// DeadLetter is an append-only NDJSON record of objects that exhausted
+// their retries, so a migration can be resumed for just those objects
+// with --replay instead of re-listing (and re-diffing against the
+// manifest) the whole source bucket.
+type DeadLetter struct {
+	mu sync.Mutex
+	f  *os.File
+}
+
+// OpenDeadLetter creates or appends to the dead-letter file at path.
+func OpenDeadLetter(path string) (*DeadLetter, error) {
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o644)
+	if err != nil {
+		return nil, err
+	}
+	return &DeadLetter{f: f}, nil
+}
+
+// Record appends entry to the dead-letter file.
+func (d *DeadLetter) Record(entry minio.ObjectInfo) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	b, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	b = append(b, '\n')
+	_, err = d.f.Write(b)
+	return err
+}
+
+// Close closes the underlying dead-letter file.
+func (d *DeadLetter) Close() error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.f.Close()
+}
+
+// LoadDeadLetter reads back the ObjectInfo entries written by Record, for
+// --replay.
+func LoadDeadLetter(path string) ([]minio.ObjectInfo, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var entries []minio.ObjectInfo
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 0, 64*1024), 1<<20)
+	for scanner.Scan() {
+		var e minio.ObjectInfo
+		if err := json.Unmarshal(scanner.Bytes(), &e); err != nil {
+			continue
+		}
+		entries = append(entries, e)
+	}
+	return entries, scanner.Err()
+}
@@ -0,0 +1,111 @@
+// Copyright 2023 Harshavardhana
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/minio/minio-go/v7"
+)
+
+func errResponse(statusCode int, code string) error {
+	return minio.ErrorResponse{StatusCode: statusCode, Code: code}
+}
+
+func TestClassifyErr(t *testing.T) {
+	if classifyErr("k", nil) != nil {
+		t.Fatal("classifyErr(nil) should return nil")
+	}
+
+	for _, status := range []int{http.StatusForbidden, http.StatusUnauthorized, http.StatusNotFound} {
+		oe := classifyErr("k", errResponse(status, ""))
+		if oe.Retryable {
+			t.Errorf("status %d should be terminal, got Retryable=true", status)
+		}
+	}
+
+	for _, code := range []string{"BadDigest", "InvalidDigest"} {
+		oe := classifyErr("k", errResponse(0, code))
+		if oe.Retryable {
+			t.Errorf("code %q should be terminal, got Retryable=true", code)
+		}
+	}
+
+	oe := classifyErr("k", errResponse(http.StatusInternalServerError, "InternalError"))
+	if !oe.Retryable {
+		t.Error("5xx should be retryable")
+	}
+}
+
+func TestWithRetryStopsOnTerminalError(t *testing.T) {
+	var attempts int
+	err := withRetry(context.Background(), RetryConfig{Base: time.Millisecond, Cap: time.Millisecond, MaxAttempts: 5}, "k", func() error {
+		attempts++
+		return errResponse(http.StatusNotFound, "")
+	})
+	if err == nil {
+		t.Fatal("expected error")
+	}
+	if attempts != 1 {
+		t.Fatalf("terminal error should not be retried, got %d attempts", attempts)
+	}
+}
+
+func TestWithRetryExhaustsAttempts(t *testing.T) {
+	var attempts int
+	err := withRetry(context.Background(), RetryConfig{Base: time.Millisecond, Cap: time.Millisecond, MaxAttempts: 3}, "k", func() error {
+		attempts++
+		return errResponse(http.StatusInternalServerError, "InternalError")
+	})
+	if err == nil {
+		t.Fatal("expected error after exhausting attempts")
+	}
+	if attempts != 3 {
+		t.Fatalf("attempts = %d, want 3", attempts)
+	}
+}
+
+func TestWithRetrySucceedsEventually(t *testing.T) {
+	var attempts int
+	err := withRetry(context.Background(), RetryConfig{Base: time.Millisecond, Cap: time.Millisecond, MaxAttempts: 3}, "k", func() error {
+		attempts++
+		if attempts < 2 {
+			return errResponse(http.StatusInternalServerError, "InternalError")
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("withRetry returned %v, want nil", err)
+	}
+	if attempts != 2 {
+		t.Fatalf("attempts = %d, want 2", attempts)
+	}
+}
+
+func TestWithRetryRespectsContextCancellation(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	err := withRetry(ctx, RetryConfig{Base: time.Second, Cap: time.Second, MaxAttempts: 5}, "k", func() error {
+		return errResponse(http.StatusInternalServerError, "InternalError")
+	})
+	if !errors.Is(err, context.Canceled) {
+		t.Fatalf("withRetry error = %v, want context.Canceled", err)
+	}
+}
@@ -15,22 +15,34 @@
 package main
 
 import (
+	"bytes"
 	"context"
 	"crypto/tls"
+	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
 	"log"
 	"net"
 	"net/http"
 	"os"
-	"runtime"
 	"sync"
 	"time"
 
+	"github.com/google/uuid"
 	"github.com/minio/minio-go/v7"
 	"github.com/minio/minio-go/v7/pkg/credentials"
+
+	"github.com/harshavardhana/ziptransfer/batch"
+	"github.com/harshavardhana/ziptransfer/encryption"
 )
 
+// dedupMapObject is the well-known key, under the destination bucket, that
+// holds a JSON snapshot of the manifest's ETag-to-key dedup index. It lets
+// a run on a fresh machine (with no local manifest) still find content
+// that a previous run already delivered.
+const dedupMapObject = ".ziptransfer/dedup-map.json"
+
 // Workers provides a bounded semaphore with the ability to wait until all
 // concurrent jobs finish.
 type Workers struct {
@@ -71,21 +83,159 @@ func (jt *Workers) Wait() {
 	jt.wg.Wait()
 }
 
-func writeAsZip(srcClnt, destClnt *minio.Client, srcBucket, destBucket string, workers *Workers, entries []minio.ObjectInfo) {
+// writeAsZip packs entries into one or more destination snowball tarballs.
+// Before touching the network it consults manifest so that objects already
+// delivered by a previous, interrupted run are skipped, and (when dedup is
+// enabled) objects whose content already exists at the destination under a
+// different key are materialized via a server-side copy instead of being
+// re-uploaded from the source.
+//
+// srcSSE and destSSE, if configured, decrypt objects read from the source
+// and encrypt objects written to the destination respectively; reading
+// with one scheme and writing with another rewraps the object.
+//
+// The remaining entries are grouped by their object-lock retention, legal
+// hold, tag and user-metadata signature, and one snowball tarball is
+// uploaded per group: PutObjectsSnowball applies a single PutObjectOptions
+// to every object it packs, so this is the only way per-object WORM
+// metadata survives the tar packing.
+//
+// Objects that fail to copy, after exhausting withRetry, are written to
+// deadLetter (if non-nil) instead of aborting the run; --replay reads that
+// file back to give them another pass without re-listing the source
+// bucket.
+//
+// writeAsZip returns one Result per entry it resolved (copied, deduped or
+// failed), so a caller driving several batches can tally a run-wide total
+// instead of only seeing each batch's own printed summary.
+func writeAsZip(srcClnt, destClnt *minio.Client, srcBucket, destBucket string, workers *Workers, entries []minio.ObjectInfo, manifest *Manifest, dedup bool, srcSSE, destSSE encryption.Config, policy RetentionPolicy, deadLetter *DeadLetter) []Result {
+	results := make(chan Result, len(entries))
+
+	var toPack []minio.ObjectInfo
+	for _, entry := range entries {
+		if manifest.Seen(entry.Key, entry.Size, entry.ETag) {
+			continue
+		}
+
+		if dedup {
+			if target, ok := manifest.DedupTarget(entry.ETag); ok && target.Key != entry.Key {
+				if err := writeDedupRef(destClnt, destBucket, entry, target, destSSE); err != nil {
+					recordFailure(deadLetter, results, entry, err)
+					continue
+				}
+				if err := manifest.Record(ManifestEntry{
+					Key: entry.Key, Size: entry.Size, ETag: entry.ETag,
+					SnowballID: target.Key, ModTime: entry.LastModified,
+				}); err != nil {
+					fmt.Println("ERROR: recording manifest for ", entry.Key, err)
+				}
+				results <- Result{Key: entry.Key}
+				continue
+			}
+		}
+
+		toPack = append(toPack, entry)
+	}
+
+	if len(toPack) == 0 {
+		close(results)
+		var all []Result
+		for res := range results {
+			all = append(all, res)
+		}
+		return all
+	}
+
+	groups := make(map[string][]minio.ObjectInfo)
+	worms := make(map[string]objectWORM)
+	for _, entry := range toPack {
+		w, err := fetchObjectWORM(context.Background(), srcClnt, srcBucket, entry, policy)
+		if err != nil {
+			recordFailure(deadLetter, results, entry, err)
+			continue
+		}
+
+		sig := w.signature()
+		groups[sig] = append(groups[sig], entry)
+		worms[sig] = w
+	}
+
+	t := time.Now()
+	var copied int
+	for sig, group := range groups {
+		copied += uploadGroup(srcClnt, destClnt, srcBucket, destBucket, workers, group, worms[sig], manifest, srcSSE, destSSE, deadLetter, results)
+	}
+	close(results)
+
+	var all []Result
+	var failed int
+	for res := range results {
+		all = append(all, res)
+		if res.Err != nil {
+			failed++
+		}
+	}
+
+	if dedup {
+		if err := publishDedupMap(destClnt, destBucket, manifest); err != nil {
+			fmt.Println("ERROR: publishing dedup map: ", err)
+		}
+	}
+
+	fmt.Printf("Copied %d objects in %s successfully, %d failed\n", copied, time.Since(t), failed)
+	return all
+}
+
+// recordFailure logs a single object's failure, writes it to deadLetter (if
+// non-nil) for a later --replay pass, and reports it on results (if
+// non-nil).
+func recordFailure(deadLetter *DeadLetter, results chan<- Result, entry minio.ObjectInfo, err error) {
+	fmt.Println("ERROR: ", err, entry.Key)
+	if deadLetter != nil {
+		if derr := deadLetter.Record(entry); derr != nil {
+			fmt.Println("ERROR: recording dead letter for ", entry.Key, derr)
+		}
+	}
+	if results != nil {
+		results <- Result{Key: entry.Key, Err: err}
+	}
+}
+
+// uploadGroup packs entries, which must all share worm's WORM signature,
+// into a single snowball tarball and records each one in manifest once the
+// upload succeeds. Only entries whose GetObject (retried via withRetry)
+// actually succeeds are packed; entries that fail are reported through
+// recordFailure and excluded from the snowball entirely, so a mid-batch
+// failure can't be mistaken for a successful copy. uploadGroup returns the
+// number of entries it copied.
+func uploadGroup(srcClnt, destClnt *minio.Client, srcBucket, destBucket string, workers *Workers, entries []minio.ObjectInfo, worm objectWORM, manifest *Manifest, srcSSE, destSSE encryption.Config, deadLetter *DeadLetter, results chan<- Result) int {
+	// PutObjectsSnowball applies a single PutObjectOptions, and therefore a
+	// single SSE-C derived key, to every object packed into this group's
+	// tarball -- unlike the source side, which derives a fresh key per
+	// entry.Key in GetObject below. snowballID is generated once up front
+	// (instead of after a successful upload, as a plain grouping label)
+	// and used as the derivation salt *and* recorded in every entry's
+	// ManifestEntry.SnowballID, so the key stays reproducible from the
+	// manifest after the run exits -- a throwaway value discarded once
+	// uploadGroup returns would make the object permanently undecryptable.
+	snowballID := uuid.NewString()
+	destSide, err := destSSE.ServerSide(snowballID)
+	if err != nil {
+		log.Fatalln(err)
+	}
+
 	input := make(chan minio.SnowballObject, 1)
 	opts := minio.SnowballOptions{
-		Opts:     minio.PutObjectOptions{},
+		Opts:     worm.putObjectOptions(minio.PutObjectOptions{ServerSideEncryption: destSide}),
 		InMemory: os.Getenv("INMEMORY") == "true",
 		Compress: os.Getenv("COMPRESS") == "true",
 		SkipErrs: os.Getenv("SKIPERRS") == "true",
 	}
 
-	t := time.Now()
-
-	var total int64
-	for _, entry := range entries {
-		total += entry.Size
-	}
+	var (
+		packedMu sync.Mutex
+		packed   []minio.ObjectInfo
+	)
 
 	go func() {
 		defer close(input)
@@ -96,13 +246,36 @@ func writeAsZip(srcClnt, destClnt *minio.Client, srcBucket, destBucket string, w
 			workers.Take()
 			go func() {
 				defer workers.Give()
-				r, err := srcClnt.GetObject(context.Background(), srcBucket,
-					entry.Key, minio.GetObjectOptions{})
+
+				var r *minio.Object
+				err := withRetry(context.Background(), DefaultRetry, entry.Key, func() error {
+					srcSide, err := srcSSE.ServerSide(entry.Key)
+					if err != nil {
+						return err
+					}
+
+					obj, err := srcClnt.GetObject(context.Background(), srcBucket,
+						entry.Key, minio.GetObjectOptions{ServerSideEncryption: srcSide})
+					if err != nil {
+						return err
+					}
+					if _, err := obj.Stat(); err != nil {
+						obj.Close()
+						return err
+					}
+
+					r = obj
+					return nil
+				})
 				if err != nil {
-					fmt.Println("ERROR: ", err, entry.Key)
+					recordFailure(deadLetter, results, entry, err)
 					return
 				}
 
+				packedMu.Lock()
+				packed = append(packed, entry)
+				packedMu.Unlock()
+
 				input <- minio.SnowballObject{
 					// Create path to store objects within the bucket.
 					Key:     entry.Key,
@@ -118,12 +291,95 @@ func writeAsZip(srcClnt, destClnt *minio.Client, srcBucket, destBucket string, w
 		workers.Wait()
 	}()
 
-	// Collect and upload all entries.
+	// Collect and upload all entries that were successfully packed.
 	if err := destClnt.PutObjectsSnowball(context.Background(), destBucket, opts, input); err != nil {
-		log.Fatalln(err)
+		for _, entry := range packed {
+			recordFailure(deadLetter, results, entry, err)
+		}
+		return 0
+	}
+
+	for _, entry := range packed {
+		if err := manifest.Record(ManifestEntry{
+			Key: entry.Key, Size: entry.Size, ETag: entry.ETag,
+			SnowballID: snowballID, ModTime: entry.LastModified,
+		}); err != nil {
+			fmt.Println("ERROR: recording manifest for ", entry.Key, err)
+		}
+		if results != nil {
+			results <- Result{Key: entry.Key}
+		}
 	}
 
-	fmt.Printf("Copied %d objects in %s successfully\n", len(entries), time.Since(t))
+	return len(packed)
+}
+
+// writeDedupRef materializes entry.Key as a full, independently readable
+// copy of the destination object at canonical.Key (matched by ETag), via a
+// server-side CopyObject. This avoids re-reading and re-uploading identical
+// content from the source, which is common in backup workloads, while
+// still leaving entry.Key resolving to the real payload for any ordinary
+// GetObject caller -- unlike a zero-byte pointer object, which would
+// silently truncate data at every deduped key.
+//
+// When destSSE is SSE-C, the copy source must be decrypted with the key
+// canonical.Key was originally written under -- canonical.SnowballID, the
+// same per-group derivation salt uploadGroup recorded for it -- and the
+// copy destination re-encrypted with a key derived from entry.Key, the same
+// way replayVersion's single-object PutObject does.
+func writeDedupRef(destClnt *minio.Client, destBucket string, entry minio.ObjectInfo, canonical ManifestEntry, destSSE encryption.Config) error {
+	srcSide, err := destSSE.ServerSide(canonical.SnowballID)
+	if err != nil {
+		return err
+	}
+	destSide, err := destSSE.ServerSide(entry.Key)
+	if err != nil {
+		return err
+	}
+
+	src := minio.CopySrcOptions{Bucket: destBucket, Object: canonical.Key, Encryption: srcSide}
+	dst := minio.CopyDestOptions{Bucket: destBucket, Object: entry.Key, Encryption: destSide}
+	_, err = destClnt.CopyObject(context.Background(), dst, src)
+	return err
+}
+
+// publishDedupMap writes the manifest's current ETag-to-key index as a
+// sidecar JSON object in the destination bucket, so a run on a different
+// machine with no local manifest can still discover already-uploaded
+// content.
+func publishDedupMap(destClnt *minio.Client, destBucket string, manifest *Manifest) error {
+	b, err := json.Marshal(manifest.DedupMap())
+	if err != nil {
+		return err
+	}
+	_, err = destClnt.PutObject(context.Background(), destBucket, dedupMapObject,
+		bytes.NewReader(b), int64(len(b)), minio.PutObjectOptions{ContentType: "application/json"})
+	return err
+}
+
+// loadDedupMap fetches the sidecar dedup map from the destination bucket,
+// if present, and returns it as ETag -> destination key. A missing object
+// is not an error; it simply means no prior run has published one yet.
+func loadDedupMap(destClnt *minio.Client, destBucket string) (map[string]string, error) {
+	obj, err := destClnt.GetObject(context.Background(), destBucket, dedupMapObject, minio.GetObjectOptions{})
+	if err != nil {
+		return nil, err
+	}
+	defer obj.Close()
+
+	b, err := io.ReadAll(obj)
+	if err != nil {
+		if resp := minio.ToErrorResponse(err); resp.Code == "NoSuchKey" {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	dedup := make(map[string]string)
+	if err := json.Unmarshal(b, &dedup); err != nil {
+		return nil, err
+	}
+	return dedup, nil
 }
 
 func main() {
@@ -133,8 +389,13 @@ func main() {
 		srcPrefix  = os.Getenv("SRC_PREFIX")
 		srcBucket  = os.Getenv("SRC_BUCKET")
 		destBucket = os.Getenv("DEST_BUCKET")
+		replayPath string
 	)
 
+	if len(os.Args) >= 3 && os.Args[1] == "--replay" {
+		replayPath = os.Args[2]
+	}
+
 	transport := &http.Transport{
 		Proxy: http.ProxyFromEnvironment,
 		DialContext: (&net.Dialer{
@@ -160,7 +421,7 @@ func main() {
 	srcClnt, err := minio.New(os.Getenv("SRC_SERVER"), &minio.Options{
 		Creds:     credentials.NewStaticV4(os.Getenv("SRC_ACCESS_KEY"), os.Getenv("SRC_SECRET_KEY"), ""),
 		Secure:    os.Getenv("SRC_SECURE") == "true",
-		Transport: transport,
+		Transport: throttleTransport("SRC_", transport),
 	})
 	if err != nil {
 		log.Fatal(err)
@@ -169,44 +430,129 @@ func main() {
 	destClnt, err := minio.New(os.Getenv("DEST_SERVER"), &minio.Options{
 		Creds:     credentials.NewStaticV4(os.Getenv("DEST_ACCESS_KEY"), os.Getenv("DEST_SECRET_KEY"), ""),
 		Secure:    os.Getenv("DEST_SECURE") == "true",
-		Transport: transport,
+		Transport: throttleTransport("DST_", transport),
 	})
 	if err != nil {
 		log.Fatal(err)
 	}
 
-	opts := minio.ListObjectsOptions{
-		Recursive: true,
-		Prefix:    srcPrefix,
+	srcSSE, err := encryption.FromEnv("SRC_")
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	destSSE, err := encryption.FromEnv("DEST_")
+	if err != nil {
+		log.Fatal(err)
 	}
 
-	workers, err := New(runtime.GOMAXPROCS(0))
+	manifestPath := os.Getenv("MANIFEST_PATH")
+	if manifestPath == "" {
+		manifestPath = "ziptransfer-manifest.ndjson"
+	}
+	manifest, err := OpenManifest(manifestPath)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer manifest.Close()
+
+	dedup := os.Getenv("DEDUP") == "true"
+	if dedup {
+		dedupMap, err := loadDedupMap(destClnt, destBucket)
+		if err != nil {
+			fmt.Println("ERROR: loading dedup map: ", err)
+		}
+		manifest.ImportDedupMap(dedupMap)
+	}
+
+	policy := RetentionPolicyFromEnv()
+
+	deadLetterPath := os.Getenv("DEADLETTER_PATH")
+	if deadLetterPath == "" {
+		deadLetterPath = "ziptransfer-deadletter.ndjson"
+	}
+	deadLetter, err := OpenDeadLetter(deadLetterPath)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer deadLetter.Close()
+
+	batchMetrics := batch.NewBatchMetrics()
+	batch.ServeMetrics(os.Getenv("METRICS_ADDR"), batchMetrics)
+
+	workers, err := New(maxConcurrentGets())
 	if err != nil {
 		log.Fatal(err)
 		return
 	}
 
-	objectsCh := srcClnt.ListObjects(context.Background(), srcBucket, opts)
+	batcher := batch.NewBatcher(batch.BatcherConfigFromEnv(), batchMetrics)
+
+	if replayPath != "" {
+		entries, err := LoadDeadLetter(replayPath)
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		var results []Result
+		for _, entry := range entries {
+			if manifest.Seen(entry.Key, entry.Size, entry.ETag) {
+				continue
+			}
+			if flushed := batcher.Add(entry); flushed != nil {
+				results = append(results, writeAsZip(srcClnt, destClnt, srcBucket, destBucket, workers, flushed, manifest, dedup, srcSSE, destSSE, policy, deadLetter)...)
+			}
+		}
+		results = append(results, writeAsZip(srcClnt, destClnt, srcBucket, destBucket, workers, batcher.Flush(), manifest, dedup, srcSSE, destSSE, policy, deadLetter)...)
+		printOverallSummary(results)
+		return
+	}
+
+	if os.Getenv("VERSIONED") == "true" {
+		runVersioned(srcClnt, destClnt, srcBucket, destBucket, srcPrefix, workers, manifest, dedup, srcSSE, destSSE, policy, versionWindowFromEnv(), batchMetrics, deadLetter)
+		return
+	}
+
+	opts := minio.ListObjectsOptions{
+		Recursive:    true,
+		Prefix:       srcPrefix,
+		WithMetadata: true,
+	}
 
-	var entries []minio.ObjectInfo
+	objectsCh := srcClnt.ListObjects(context.Background(), srcBucket, opts)
 
 	// List all objects from a bucket-name with a matching prefix.
+	var results []Result
 	for {
 		select {
 		case object, ok := <-objectsCh:
 			if !ok {
-				writeAsZip(srcClnt, destClnt, srcBucket, destBucket, workers, entries)
+				results = append(results, writeAsZip(srcClnt, destClnt, srcBucket, destBucket, workers, batcher.Flush(), manifest, dedup, srcSSE, destSSE, policy, deadLetter)...)
+				printOverallSummary(results)
 				return
 			}
 			if object.Err != nil {
 				fmt.Printf("ERROR: listing failed %v\n", object.Err)
 				continue
 			}
-			entries = append(entries, object)
-			if len(entries) == 100 {
-				writeAsZip(srcClnt, destClnt, srcBucket, destBucket, workers, entries)
-				entries = []minio.ObjectInfo{}
+			if manifest.Seen(object.Key, object.Size, object.ETag) {
+				continue
+			}
+			if flushed := batcher.Add(object); flushed != nil {
+				results = append(results, writeAsZip(srcClnt, destClnt, srcBucket, destBucket, workers, flushed, manifest, dedup, srcSSE, destSSE, policy, deadLetter)...)
 			}
 		}
 	}
 }
+
+// printOverallSummary reports the run-wide totals across every writeAsZip
+// batch, derived from the per-object Results each batch returned.
+func printOverallSummary(results []Result) {
+	var failed int
+	for _, res := range results {
+		if res.Err != nil {
+			failed++
+		}
+	}
+	fmt.Printf("Run complete: %d objects processed, %d failed\n", len(results), failed)
+}
@@ -0,0 +1,179 @@
+// Copyright 2023 Harshavardhana
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"os"
+	"sync"
+	"time"
+)
+
+// ManifestEntry records the outcome of packing a single source object into
+// a destination snowball tarball, keyed by the object's identity on the
+// source side.
+type ManifestEntry struct {
+	Key        string    `json:"key"`
+	Size       int64     `json:"size"`
+	ETag       string    `json:"etag"`
+	SnowballID string    `json:"snowballId"`
+	ModTime    time.Time `json:"modTime"`
+}
+
+// Manifest is an append-only, NDJSON-backed record of objects that have
+// already been delivered to the destination bucket. Keeping it alongside a
+// run lets a long copy be interrupted and resumed without re-uploading
+// objects that were already copied, and lets identical blobs (matched by
+// ETag) be packed once and server-side copied to their other keys rather
+// than uploaded again.
+type Manifest struct {
+	mu      sync.Mutex
+	f       *os.File
+	entries map[string]ManifestEntry // keyed by source Key
+	byETag  map[string]ManifestEntry // ETag -> first entry recorded with it
+}
+
+// OpenManifest loads an existing manifest from path, replaying it into
+// memory, and leaves the file open for append. The file is created if it
+// does not yet exist.
+func OpenManifest(path string) (*Manifest, error) {
+	m := &Manifest{
+		entries: make(map[string]ManifestEntry),
+		byETag:  make(map[string]ManifestEntry),
+	}
+
+	if rf, err := os.Open(path); err == nil {
+		scanner := bufio.NewScanner(rf)
+		scanner.Buffer(make([]byte, 0, 64*1024), 1<<20)
+		for scanner.Scan() {
+			var e ManifestEntry
+			if err := json.Unmarshal(scanner.Bytes(), &e); err != nil {
+				// Ignore a partially written trailing line left behind by
+				// a run that crashed mid-write.
+				continue
+			}
+			m.entries[e.Key] = e
+			if e.ETag != "" {
+				if _, ok := m.byETag[e.ETag]; !ok {
+					m.byETag[e.ETag] = e
+				}
+			}
+		}
+		rf.Close()
+		if err := scanner.Err(); err != nil {
+			return nil, err
+		}
+	} else if !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o644)
+	if err != nil {
+		return nil, err
+	}
+	m.f = f
+
+	return m, nil
+}
+
+// Seen reports whether key has already been delivered to the destination
+// with the given size and ETag. A mismatch on either field means the
+// source object has changed since the last run and must be re-copied.
+func (m *Manifest) Seen(key string, size int64, etag string) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	e, ok := m.entries[key]
+	return ok && e.Size == size && e.ETag == etag
+}
+
+// DedupTarget returns the entry already delivered to the destination that
+// has the given ETag, if one has been recorded. Its Key identifies the
+// destination object that can be referenced instead of packing identical
+// content a second time.
+func (m *Manifest) DedupTarget(etag string) (ManifestEntry, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	e, ok := m.byETag[etag]
+	return e, ok
+}
+
+// Record appends e to the manifest and updates the in-memory index. It is
+// flushed to disk before returning so that a crash immediately afterwards
+// does not lose the entry.
+func (m *Manifest) Record(e ManifestEntry) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	b, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	b = append(b, '\n')
+	if _, err := m.f.Write(b); err != nil {
+		return err
+	}
+	if err := m.f.Sync(); err != nil {
+		return err
+	}
+
+	m.entries[e.Key] = e
+	if e.ETag != "" {
+		if _, ok := m.byETag[e.ETag]; !ok {
+			m.byETag[e.ETag] = e
+		}
+	}
+	return nil
+}
+
+// Close flushes and closes the underlying manifest file.
+func (m *Manifest) Close() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.f.Close()
+}
+
+// DedupMap returns a snapshot of ETag to destination Key, suitable for
+// publishing as a sidecar object in the destination bucket so that other
+// tools (or a future run pointed at a fresh manifest) can find already
+// deduplicated content without replaying the whole NDJSON manifest.
+func (m *Manifest) DedupMap() map[string]string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	out := make(map[string]string, len(m.byETag))
+	for etag, e := range m.byETag {
+		out[etag] = e.Key
+	}
+	return out
+}
+
+// ImportDedupMap seeds the in-memory dedup index from a previously
+// published sidecar map (etag -> destination key), without touching the
+// NDJSON manifest on disk. It is used to bootstrap dedup lookups from the
+// destination bucket when no local manifest exists yet, e.g. on a fresh
+// machine resuming someone else's run.
+func (m *Manifest) ImportDedupMap(dedup map[string]string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for etag, key := range dedup {
+		if _, ok := m.byETag[etag]; !ok {
+			m.byETag[etag] = ManifestEntry{Key: key, ETag: etag}
+		}
+	}
+}
@@ -0,0 +1,201 @@
+// Copyright 2023 Harshavardhana
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"os"
+	"runtime"
+	"strconv"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+// maxConcurrentGets returns MAX_CONCURRENT_GETS if set to a positive
+// value, decoupling source download parallelism from the machine's CPU
+// count; otherwise it falls back to runtime.GOMAXPROCS(0), the tool's
+// original default.
+func maxConcurrentGets() int {
+	if v, err := strconv.Atoi(os.Getenv("MAX_CONCURRENT_GETS")); err == nil && v > 0 {
+		return v
+	}
+	return runtime.GOMAXPROCS(0)
+}
+
+// NightModeSchedule raises the rate limit during a daily hour window, in
+// local time, so operators can let a large snowball migration run faster
+// overnight without saturating production links during business hours.
+// EndHour may be less than StartHour to express a window that wraps past
+// midnight (e.g. 22 to 6).
+type NightModeSchedule struct {
+	StartHour, EndHour int
+	BytesPerSec        int64
+	Burst              int
+}
+
+func (s NightModeSchedule) active(t time.Time) bool {
+	h := t.Hour()
+	if s.StartHour <= s.EndHour {
+		return h >= s.StartHour && h < s.EndHour
+	}
+	return h >= s.StartHour || h < s.EndHour
+}
+
+// BandwidthLimiter is a byte-budget token bucket, with an optional
+// elevated burst/rate that takes over during a NightModeSchedule window.
+// It aggregates demand from every connection sharing it, even though
+// net/http opens one physical connection per concurrent request.
+type BandwidthLimiter struct {
+	day    *rate.Limiter
+	night  *rate.Limiter
+	sched  NightModeSchedule
+	hasDay bool
+}
+
+// defaultMinBurst is the floor applied when no explicit burst is
+// configured, comfortably above the ~32KB chunks a typical io.Reader
+// hands back per Read call.
+const defaultMinBurst = 64 * 1024
+
+// defaultBurst picks a burst size for a rate with no explicit burst
+// configured: bytesPerSec itself, unless that is smaller than
+// defaultMinBurst, in which case WaitN's chunking keeps throttling
+// correct either way, but a tiny burst would otherwise serialize every
+// read into many small waits for no benefit.
+func defaultBurst(bytesPerSec int64) int {
+	if bytesPerSec > defaultMinBurst {
+		return int(bytesPerSec)
+	}
+	return defaultMinBurst
+}
+
+// NewBandwidthLimiter returns a BandwidthLimiter capping throughput at
+// bytesPerSec with the given burst. bytesPerSec <= 0 disables the daytime
+// limit; sched may be nil to disable night mode.
+func NewBandwidthLimiter(bytesPerSec int64, burst int, sched *NightModeSchedule) *BandwidthLimiter {
+	if bytesPerSec <= 0 && sched == nil {
+		return nil
+	}
+
+	l := &BandwidthLimiter{hasDay: bytesPerSec > 0}
+	if l.hasDay {
+		if burst <= 0 {
+			burst = defaultBurst(bytesPerSec)
+		}
+		l.day = rate.NewLimiter(rate.Limit(bytesPerSec), burst)
+	}
+	if sched != nil {
+		l.sched = *sched
+		night := sched.Burst
+		if night <= 0 {
+			night = defaultBurst(sched.BytesPerSec)
+		}
+		l.night = rate.NewLimiter(rate.Limit(sched.BytesPerSec), night)
+	}
+
+	return l
+}
+
+// WaitN blocks until n bytes may be consumed under the currently active
+// limit, day or night. n is split into chunks no larger than the active
+// limiter's burst: rate.Limiter.WaitN rejects any single call requesting
+// more than its burst outright, and net/http reads bodies in chunks (~32KB)
+// that can exceed a burst sized for a low BW setting.
+func (l *BandwidthLimiter) WaitN(ctx context.Context, n int) error {
+	lim := l.day
+	if l.night != nil && l.sched.active(time.Now()) {
+		lim = l.night
+	}
+	if lim == nil {
+		return nil
+	}
+
+	burst := lim.Burst()
+	for n > 0 {
+		chunk := n
+		if chunk > burst {
+			chunk = burst
+		}
+		if err := lim.WaitN(ctx, chunk); err != nil {
+			return err
+		}
+		n -= chunk
+	}
+	return nil
+}
+
+// throttledTransport wraps an http.RoundTripper, metering both the request
+// body (e.g. PUT upload payloads) read by base and the response body (e.g.
+// GET downloads) read by the caller through limiter.
+type throttledTransport struct {
+	base    http.RoundTripper
+	limiter *BandwidthLimiter
+}
+
+func (t *throttledTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if t.limiter != nil && req.Body != nil {
+		req.Body = &throttledBody{rc: req.Body, limiter: t.limiter}
+	}
+
+	resp, err := t.base.RoundTrip(req)
+	if err != nil || t.limiter == nil || resp.Body == nil {
+		return resp, err
+	}
+	resp.Body = &throttledBody{rc: resp.Body, limiter: t.limiter}
+	return resp, nil
+}
+
+type throttledBody struct {
+	rc      io.ReadCloser
+	limiter *BandwidthLimiter
+}
+
+func (t *throttledBody) Read(p []byte) (int, error) {
+	n, err := t.rc.Read(p)
+	if n > 0 {
+		if werr := t.limiter.WaitN(context.Background(), n); werr != nil && err == nil {
+			err = werr
+		}
+	}
+	return n, err
+}
+
+func (t *throttledBody) Close() error { return t.rc.Close() }
+
+// throttleTransport returns base unchanged if no rate limit is configured
+// under prefix, or wraps it in a throttledTransport that enforces
+// <prefix>BW (bytes/sec), <prefix>BW_BURST and the shared
+// NIGHT_START_HOUR/NIGHT_END_HOUR/<prefix>NIGHT_BW schedule.
+func throttleTransport(prefix string, base http.RoundTripper) http.RoundTripper {
+	bytesPerSec, _ := strconv.ParseInt(os.Getenv(prefix+"BW"), 10, 64)
+	burst, _ := strconv.Atoi(os.Getenv(prefix + "BW_BURST"))
+
+	var sched *NightModeSchedule
+	startHour, startErr := strconv.Atoi(os.Getenv("NIGHT_START_HOUR"))
+	endHour, endErr := strconv.Atoi(os.Getenv("NIGHT_END_HOUR"))
+	if nightBW, err := strconv.ParseInt(os.Getenv(prefix+"NIGHT_BW"), 10, 64); err == nil && nightBW > 0 && startErr == nil && endErr == nil {
+		nightBurst, _ := strconv.Atoi(os.Getenv(prefix + "NIGHT_BW_BURST"))
+		sched = &NightModeSchedule{StartHour: startHour, EndHour: endHour, BytesPerSec: nightBW, Burst: nightBurst}
+	}
+
+	limiter := NewBandwidthLimiter(bytesPerSec, burst, sched)
+	if limiter == nil {
+		return base
+	}
+	return &throttledTransport{base: base, limiter: limiter}
+}
@@ -0,0 +1,61 @@
+// Copyright 2023 Harshavardhana
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestNightModeScheduleActive(t *testing.T) {
+	at := func(hour int) time.Time {
+		return time.Date(2024, time.January, 1, hour, 0, 0, 0, time.UTC)
+	}
+
+	t.Run("same day window", func(t *testing.T) {
+		s := NightModeSchedule{StartHour: 9, EndHour: 17}
+		if s.active(at(8)) {
+			t.Error("8:00 should be outside 9-17")
+		}
+		if !s.active(at(9)) {
+			t.Error("9:00 should be inside 9-17")
+		}
+		if !s.active(at(16)) {
+			t.Error("16:00 should be inside 9-17")
+		}
+		if s.active(at(17)) {
+			t.Error("17:00 should be outside 9-17 (end excluded)")
+		}
+	})
+
+	t.Run("midnight wraparound", func(t *testing.T) {
+		s := NightModeSchedule{StartHour: 22, EndHour: 6}
+		if !s.active(at(23)) {
+			t.Error("23:00 should be inside 22-6 wraparound window")
+		}
+		if !s.active(at(0)) {
+			t.Error("0:00 should be inside 22-6 wraparound window")
+		}
+		if !s.active(at(5)) {
+			t.Error("5:00 should be inside 22-6 wraparound window")
+		}
+		if s.active(at(6)) {
+			t.Error("6:00 should be outside 22-6 wraparound window (end excluded)")
+		}
+		if s.active(at(12)) {
+			t.Error("12:00 should be outside 22-6 wraparound window")
+		}
+	})
+}
@@ -0,0 +1,189 @@
+// Copyright 2023 Harshavardhana
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+
+	"github.com/minio/minio-go/v7"
+
+	"github.com/harshavardhana/ziptransfer/batch"
+	"github.com/harshavardhana/ziptransfer/encryption"
+)
+
+// versionWindowFromEnv reads VERSION_WINDOW, the maximum number of
+// historical (non-current) versions replicated per key. Zero, unset, or a
+// negative value means unlimited.
+func versionWindowFromEnv() int {
+	n, _ := strconv.Atoi(os.Getenv("VERSION_WINDOW"))
+	if n < 0 {
+		return 0
+	}
+	return n
+}
+
+// runVersioned copies srcBucket to destBucket reproducing the full version
+// history of every object, including delete markers, instead of only the
+// current version. PutObjectsSnowball has no notion of version IDs, so
+// only the newest version of each key is packed into a snowball tarball;
+// older versions are replayed with sequential PutObject/RemoveObject calls,
+// oldest first, so the destination's history matches the source's.
+func runVersioned(srcClnt, destClnt *minio.Client, srcBucket, destBucket, srcPrefix string, workers *Workers, manifest *Manifest, dedup bool, srcSSE, destSSE encryption.Config, policy RetentionPolicy, versionWindow int, batchMetrics *batch.BatchMetrics, deadLetter *DeadLetter) {
+	objectsCh := srcClnt.ListObjects(context.Background(), srcBucket, minio.ListObjectsOptions{
+		Recursive:    true,
+		Prefix:       srcPrefix,
+		WithVersions: true,
+		WithMetadata: true,
+	})
+
+	// Batches the newest, non-deleted version of each key for snowball
+	// packing; older versions bypass the batcher entirely.
+	batcher := batch.NewBatcher(batch.BatcherConfigFromEnv(), batchMetrics)
+
+	var (
+		currentKey string
+		versions   []minio.ObjectInfo
+		results    []Result
+	)
+
+	flushKey := func() {
+		if len(versions) == 0 {
+			return
+		}
+
+		// ListObjects returns versions of a key newest-first; chronological
+		// order is oldest-first so the destination sees creates and deletes
+		// in the same sequence the source did.
+		sort.Slice(versions, func(i, j int) bool {
+			return versions[i].LastModified.Before(versions[j].LastModified)
+		})
+
+		if versionWindow > 0 && len(versions) > versionWindow+1 {
+			// Keep the current version plus up to versionWindow historical
+			// versions; drop anything older than the window.
+			versions = versions[len(versions)-(versionWindow+1):]
+		}
+
+		for _, v := range versions[:len(versions)-1] {
+			replayHistoricalVersion(srcClnt, destClnt, srcBucket, destBucket, v, srcSSE, destSSE, manifest, deadLetter)
+		}
+
+		newest := versions[len(versions)-1]
+		if newest.IsDeleteMarker {
+			replayHistoricalVersion(srcClnt, destClnt, srcBucket, destBucket, newest, srcSSE, destSSE, manifest, deadLetter)
+		} else if flushed := batcher.Add(newest); flushed != nil {
+			results = append(results, writeAsZip(srcClnt, destClnt, srcBucket, destBucket, workers, flushed, manifest, dedup, srcSSE, destSSE, policy, deadLetter)...)
+		}
+
+		versions = versions[:0]
+	}
+
+	for object := range objectsCh {
+		if object.Err != nil {
+			fmt.Printf("ERROR: listing failed %v\n", object.Err)
+			continue
+		}
+
+		if object.Key != currentKey {
+			flushKey()
+			currentKey = object.Key
+		}
+		versions = append(versions, object)
+	}
+	flushKey()
+
+	if remaining := batcher.Flush(); len(remaining) > 0 {
+		results = append(results, writeAsZip(srcClnt, destClnt, srcBucket, destBucket, workers, remaining, manifest, dedup, srcSSE, destSSE, policy, deadLetter)...)
+	}
+
+	printOverallSummary(results)
+}
+
+// versionManifestKey identifies a single historical version for manifest
+// bookkeeping. It is distinct from v.Key (which the manifest also uses for
+// the current version written through writeAsZip) so that replaying one
+// version of a key doesn't mark other versions of the same key as seen.
+func versionManifestKey(v minio.ObjectInfo) string {
+	return v.Key + "\x00" + v.VersionID
+}
+
+// replayHistoricalVersion replays v (a non-current version or delete
+// marker) through replayVersion, first consulting manifest so a resumed
+// run doesn't replay it again -- RemoveObject has no notion of "already
+// deleted" and stacks a brand new delete marker on every call, so replaying
+// an already-replayed delete marker corrupts the destination's version
+// history instead of being a harmless no-op. The replay is recorded in
+// manifest once it succeeds.
+func replayHistoricalVersion(srcClnt, destClnt *minio.Client, srcBucket, destBucket string, v minio.ObjectInfo, srcSSE, destSSE encryption.Config, manifest *Manifest, deadLetter *DeadLetter) {
+	vkey := versionManifestKey(v)
+	if manifest.Seen(vkey, v.Size, v.ETag) {
+		return
+	}
+
+	if err := replayVersion(srcClnt, destClnt, srcBucket, destBucket, v, srcSSE, destSSE); err != nil {
+		recordFailure(deadLetter, nil, v, err)
+		return
+	}
+
+	if err := manifest.Record(ManifestEntry{
+		Key: vkey, Size: v.Size, ETag: v.ETag, ModTime: v.LastModified,
+	}); err != nil {
+		fmt.Println("ERROR: recording manifest for ", v.Key, err)
+	}
+}
+
+// replayVersion reproduces a single historical version at the destination:
+// a delete marker is recreated with RemoveObject, anything else is copied
+// with a straight PutObject of that version's content.
+func replayVersion(srcClnt, destClnt *minio.Client, srcBucket, destBucket string, v minio.ObjectInfo, srcSSE, destSSE encryption.Config) error {
+	if v.IsDeleteMarker {
+		return destClnt.RemoveObject(context.Background(), destBucket, v.Key, minio.RemoveObjectOptions{})
+	}
+
+	srcSide, err := srcSSE.ServerSide(v.Key)
+	if err != nil {
+		return err
+	}
+
+	r, err := srcClnt.GetObject(context.Background(), srcBucket, v.Key, minio.GetObjectOptions{
+		ServerSideEncryption: srcSide,
+		VersionID:            v.VersionID,
+	})
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	// Unlike uploadGroup's snowball batches, replayVersion puts one object
+	// per call, so the destination SSE-C key can be derived from the
+	// object's own key -- the same reproducible, per-object derivation the
+	// source side already uses above, instead of a constant that would
+	// give every replayed version the same data key.
+	destSide, err := destSSE.ServerSide(v.Key)
+	if err != nil {
+		return err
+	}
+
+	_, err = destClnt.PutObject(context.Background(), destBucket, v.Key, r, v.Size, minio.PutObjectOptions{
+		ServerSideEncryption: destSide,
+		UserMetadata:         v.UserMetadata,
+		UserTags:             v.UserTags,
+	})
+	return err
+}
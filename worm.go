@@ -0,0 +1,160 @@
+// Copyright 2023 Harshavardhana
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/minio/minio-go/v7"
+)
+
+// RetentionPolicy overrides the WORM metadata read off a source object.
+// It is built once from RETENTION_MODE, RETENTION_DAYS and LEGAL_HOLD so
+// that operators can tighten (or relax, where the destination allows)
+// retention on migration rather than merely mirroring the source.
+type RetentionPolicy struct {
+	Mode      minio.RetentionMode
+	Days      int
+	LegalHold minio.LegalHoldStatus
+}
+
+// RetentionPolicyFromEnv reads the policy overrides, if any, from the
+// environment. A zero-value field leaves the corresponding source value
+// untouched.
+func RetentionPolicyFromEnv() RetentionPolicy {
+	var policy RetentionPolicy
+
+	switch os.Getenv("RETENTION_MODE") {
+	case "GOVERNANCE":
+		policy.Mode = minio.Governance
+	case "COMPLIANCE":
+		policy.Mode = minio.Compliance
+	}
+
+	if days, err := strconv.Atoi(os.Getenv("RETENTION_DAYS")); err == nil && days > 0 {
+		policy.Days = days
+	}
+
+	switch os.Getenv("LEGAL_HOLD") {
+	case "on":
+		policy.LegalHold = minio.LegalHoldEnabled
+	case "off":
+		policy.LegalHold = minio.LegalHoldDisabled
+	}
+
+	return policy
+}
+
+// objectWORM is the WORM metadata signature packed alongside one object:
+// its object-lock retention, legal hold, tags and user metadata. Entries
+// sharing an identical signature can be packed into the same snowball
+// tarball since PutObjectsSnowball applies one PutObjectOptions per call.
+type objectWORM struct {
+	Mode        minio.RetentionMode
+	RetainUntil time.Time
+	LegalHold   minio.LegalHoldStatus
+	Tags        map[string]string
+	UserMeta    map[string]string
+}
+
+// fetchObjectWORM reads entry's object-lock retention and legal hold from
+// the source, applies policy on top, and carries over the tags and user
+// metadata that were already fetched as part of the listing (entry.UserTags
+// and entry.UserMetadata, populated via ListObjectsOptions.WithMetadata).
+func fetchObjectWORM(ctx context.Context, srcClnt *minio.Client, srcBucket string, entry minio.ObjectInfo, policy RetentionPolicy) (objectWORM, error) {
+	w := objectWORM{
+		Tags:     entry.UserTags,
+		UserMeta: entry.UserMetadata,
+	}
+
+	mode, retainUntil, err := srcClnt.GetObjectRetention(ctx, srcBucket, entry.Key, entry.VersionID)
+	if err != nil && minio.ToErrorResponse(err).Code != "ObjectLockConfigurationNotFoundError" {
+		return objectWORM{}, err
+	}
+	if mode != nil {
+		w.Mode = *mode
+	}
+	if retainUntil != nil {
+		w.RetainUntil = *retainUntil
+	}
+
+	status, err := srcClnt.GetObjectLegalHold(ctx, srcBucket, entry.Key, minio.GetObjectLegalHoldOptions{VersionID: entry.VersionID})
+	if err != nil && minio.ToErrorResponse(err).Code != "ObjectLockConfigurationNotFoundError" {
+		return objectWORM{}, err
+	}
+	if status != nil {
+		w.LegalHold = *status
+	}
+
+	if policy.Mode != "" {
+		w.Mode = policy.Mode
+	}
+	if policy.Days > 0 {
+		w.RetainUntil = time.Now().AddDate(0, 0, policy.Days)
+	}
+	if policy.LegalHold != "" {
+		w.LegalHold = policy.LegalHold
+	}
+
+	return w, nil
+}
+
+// signature returns a deterministic key identifying objects that can share
+// a single PutObjectOptions, and therefore a single snowball tarball.
+func (w objectWORM) signature() string {
+	var b strings.Builder
+	b.WriteString(string(w.Mode))
+	b.WriteByte('|')
+	b.WriteString(w.RetainUntil.UTC().Format(time.RFC3339))
+	b.WriteByte('|')
+	b.WriteString(string(w.LegalHold))
+	b.WriteByte('|')
+	writeSortedMap(&b, w.Tags)
+	b.WriteByte('|')
+	writeSortedMap(&b, w.UserMeta)
+	return b.String()
+}
+
+// putObjectOptions applies the WORM signature to opts, which must already
+// carry the destination's server-side-encryption settings.
+func (w objectWORM) putObjectOptions(opts minio.PutObjectOptions) minio.PutObjectOptions {
+	opts.Mode = w.Mode
+	opts.RetainUntilDate = w.RetainUntil
+	opts.LegalHold = w.LegalHold
+	opts.UserTags = w.Tags
+	opts.UserMetadata = w.UserMeta
+	return opts
+}
+
+func writeSortedMap(b *strings.Builder, m map[string]string) {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for i, k := range keys {
+		if i > 0 {
+			b.WriteByte(',')
+		}
+		b.WriteString(k)
+		b.WriteByte('=')
+		b.WriteString(m[k])
+	}
+}
@@ -0,0 +1,54 @@
+// Copyright 2023 Harshavardhana
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/minio/minio-go/v7"
+)
+
+func TestObjectWORMSignature(t *testing.T) {
+	base := objectWORM{
+		Mode:        minio.Governance,
+		RetainUntil: time.Date(2030, time.January, 1, 0, 0, 0, 0, time.UTC),
+		LegalHold:   minio.LegalHoldEnabled,
+		Tags:        map[string]string{"a": "1", "b": "2"},
+		UserMeta:    map[string]string{"x": "y"},
+	}
+
+	if base.signature() != base.signature() {
+		t.Fatal("signature() should be deterministic for the same value")
+	}
+
+	reordered := base
+	reordered.Tags = map[string]string{"b": "2", "a": "1"}
+	if base.signature() != reordered.signature() {
+		t.Fatal("signature() should not depend on map iteration order")
+	}
+
+	differentMode := base
+	differentMode.Mode = minio.Compliance
+	if base.signature() == differentMode.signature() {
+		t.Fatal("signature() should differ when Mode differs")
+	}
+
+	differentTags := base
+	differentTags.Tags = map[string]string{"a": "1"}
+	if base.signature() == differentTags.signature() {
+		t.Fatal("signature() should differ when Tags differ")
+	}
+}